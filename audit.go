@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// requestIDHeader is both read (to honor an upstream-assigned request ID)
+// and written (so callers can correlate responses with audit events).
+const requestIDHeader = "X-Request-Id"
+
+const requestIDContextKey = contextKey("requestID")
+
+// auditLogger emits one JSON object per line, independent of the
+// timestamp/prefix formatting log.Printf elsewhere in the proxy uses for
+// operational messages.
+var auditLogger = log.New(os.Stdout, "", 0)
+
+// auditEvent is a single structured record of an auth or proxy decision.
+type auditEvent struct {
+	Time      string  `json:"time"`
+	RequestID string  `json:"requestId"`
+	Outcome   string  `json:"outcome"`
+	RemoteIP  string  `json:"remoteIp"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Port      int     `json:"port,omitempty"`
+	Upstream  string  `json:"upstream,omitempty"`
+	Code      int     `json:"code,omitempty"`
+	UserID    string  `json:"userId,omitempty"`
+	Email     string  `json:"email,omitempty"`
+	JTI       string  `json:"jti,omitempty"`
+	LatencyMS float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// withRequestID assigns each request a request ID (honoring one supplied by
+// an upstream load balancer), echoes it back in the response, and stashes it
+// in the request context so audit events can reference it.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// newRequestID returns a short random hex identifier.
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// requestID returns the request's audit request ID, or "" if withRequestID
+// wasn't applied to it.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// remoteIP strips the port from RemoteAddr, falling back to the raw value if
+// it isn't a host:port pair.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// recordAuthDecision logs an authMiddleware/handleWebSocket decision and
+// increments auth_decisions_total{outcome}. claims may be nil when the
+// decision was made before (or without) a verified token.
+func recordAuthDecision(r *http.Request, start time.Time, outcome string, claims *Claims) {
+	metrics.authDecisionsTotal.inc(outcome)
+
+	event := auditEvent{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		RequestID: requestID(r),
+		Outcome:   outcome,
+		RemoteIP:  remoteIP(r),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		LatencyMS: millisSince(start),
+	}
+	applyClaims(&event, claims)
+	writeAuditEvent(event)
+}
+
+// recordProxyError logs a failure to reach an upstream, as reported by the
+// reverse proxy's ErrorHandler.
+func recordProxyError(r *http.Request, port int, err error) {
+	event := auditEvent{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		RequestID: requestID(r),
+		Outcome:   "proxy-error",
+		RemoteIP:  remoteIP(r),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Port:      port,
+		Error:     err.Error(),
+	}
+	writeAuditEvent(event)
+}
+
+// recordUpstreamStatus logs the outcome of a completed proxied request and
+// records proxy_requests_total / proxy_request_duration_seconds.
+func recordUpstreamStatus(r *http.Request, port int, upstream string, code int, start time.Time) {
+	latency := time.Since(start)
+	metrics.proxyRequestsTotal.inc(strconv.Itoa(port), upstream, strconv.Itoa(code))
+	metrics.proxyRequestDuration.observe(latency.Seconds())
+
+	event := auditEvent{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		RequestID: requestID(r),
+		Outcome:   "upstream-status",
+		RemoteIP:  remoteIP(r),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Port:      port,
+		Upstream:  upstream,
+		Code:      code,
+		LatencyMS: float64(latency.Microseconds()) / 1000,
+	}
+	if claims, ok := r.Context().Value(claimsContextKey).(*Claims); ok {
+		applyClaims(&event, claims)
+	}
+	writeAuditEvent(event)
+}
+
+// recordJWKSRefresh increments jwks_refresh_total{result}.
+func recordJWKSRefresh(result string) {
+	metrics.jwksRefreshTotal.inc(result)
+}
+
+// recordTokenRefresh increments token_refresh_total{result} for a silent
+// session renewal attempt via the refresh_token cookie.
+func recordTokenRefresh(result string) {
+	metrics.tokenRefreshTotal.inc(result)
+}
+
+// applyClaims fills in the user-identifying fields of an audit event from
+// a verified token, when one was available.
+func applyClaims(event *auditEvent, claims *Claims) {
+	if claims == nil {
+		return
+	}
+	event.UserID = claims.UserID
+	if event.UserID == "" {
+		event.UserID = claims.Sub
+	}
+	event.Email = claims.Email
+	event.JTI = claims.ID
+}
+
+// millisSince returns the elapsed time since start, in milliseconds.
+func millisSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+func writeAuditEvent(event auditEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to marshal audit event: %v", err)
+		return
+	}
+	auditLogger.Println(string(data))
+}
@@ -1,18 +1,45 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// ServerConfig represents configuration for a single server instance
+// ServerConfig represents configuration for a single server instance: a
+// listener on Port, dispatching to Routes.
 type ServerConfig struct {
+	Port   int
+	Routes *RouteTable
+}
+
+// legacyServerConfig is the pre-routing-table PORT:UPSTREAM_URL pairing,
+// used to build a trivial RouteTable when ROUTES/ROUTES_FILE aren't set.
+type legacyServerConfig struct {
 	Port        int
 	UpstreamURL string
 }
 
+// OIDCConfig represents configuration for OpenID Connect login
+type OIDCConfig struct {
+	ProviderURL  string
+	ClientID     string
+	ClientSecret string
+	RedirectPath string
+	Scopes       []string
+	StateSecret  []byte
+
+	// Discovered from the provider's /.well-known/openid-configuration
+	Issuer                string
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	JWKSURI               string
+}
+
 // Config represents the application configuration
 type Config struct {
 	Servers       []ServerConfig
@@ -21,16 +48,50 @@ type Config struct {
 	JWTKeyPath    string
 	JWTCookieName string
 	PublicPaths   []string
+	OIDC          *OIDCConfig
+	MFA           *MFAConfig
+
+	// JWTClockSkew is the leeway jwtValidator allows for exp/nbf checks,
+	// tolerating clock drift between the proxy and the IdP.
+	JWTClockSkew time.Duration
+
+	// JWTMaxLifetime caps how long after iat a token is accepted,
+	// independent of its own exp. 0 disables the check.
+	JWTMaxLifetime time.Duration
+
+	// TokenRefreshURL is the refresh_token grant endpoint authMiddleware
+	// posts to for silent renewal when the JWT cookie is missing/invalid.
+	// Defaults to OIDC.TokenEndpoint when OIDC is configured and this is
+	// unset; silent renewal is disabled entirely when both are empty, so
+	// legacy JWT_KEY_PATH deployments can still opt in by setting this.
+	TokenRefreshURL string
+
+	// MetricsAddr is the admin listener address (e.g. ":9090") serving
+	// /metrics. Metrics are disabled when unset.
+	MetricsAddr string
+
+	// WSMaxConnBytes caps the total bytes relayed in a single direction over
+	// the life of a proxied WebSocket connection before the pump gives up on
+	// it - not a per-message limit, since the pump copies raw bytes and has
+	// no notion of WebSocket frame boundaries. A long-lived, low-traffic
+	// connection (a dashboard feed, a chat session left open for hours) will
+	// eventually hit this even if no individual message was ever large.
+	// 0 means unlimited.
+	WSMaxConnBytes int64
 }
 
-// parseServers parses the SERVERS environment variable
+// parseLegacyServers parses the SERVERS environment variable
 // Format: PORT:UPSTREAM_URL,PORT:UPSTREAM_URL,...
 // Example: 3000:http://localhost:8080,3001:http://localhost:8081
-func parseServers() ([]ServerConfig, error) {
+//
+// This is the pre-routing-table configuration format; LoadConfig uses it
+// as a shim to build a trivial RouteTable per port when ROUTES/ROUTES_FILE
+// aren't set.
+func parseLegacyServers() ([]legacyServerConfig, error) {
 	serversEnv := os.Getenv("SERVERS")
 
 	if serversEnv != "" {
-		var servers []ServerConfig
+		var servers []legacyServerConfig
 		serverConfigs := strings.Split(serversEnv, ",")
 
 		for _, serverConfig := range serverConfigs {
@@ -47,7 +108,7 @@ func parseServers() ([]ServerConfig, error) {
 			// Rejoin the URL parts (http:// was split)
 			url := strings.TrimSpace(serverConfig)[len(parts[0])+1:]
 
-			servers = append(servers, ServerConfig{
+			servers = append(servers, legacyServerConfig{
 				Port:        port,
 				UpstreamURL: url,
 			})
@@ -72,7 +133,7 @@ func parseServers() ([]ServerConfig, error) {
 		upstreamURL = "http://localhost:8080"
 	}
 
-	return []ServerConfig{
+	return []legacyServerConfig{
 		{
 			Port:        port,
 			UpstreamURL: upstreamURL,
@@ -80,6 +141,137 @@ func parseServers() ([]ServerConfig, error) {
 	}, nil
 }
 
+// buildServerConfigs resolves the listener/route-table pairs to start.
+// When ROUTES or ROUTES_FILE is configured, every listener shares that
+// single routing table. Otherwise each legacy PORT:UPSTREAM_URL pair gets
+// its own trivial, single-upstream RouteTable.
+func buildServerConfigs() ([]ServerConfig, error) {
+	legacyServers, err := parseLegacyServers()
+	if err != nil {
+		return nil, err
+	}
+
+	sharedRoutes, err := loadRouteTable()
+	if err != nil {
+		return nil, err
+	}
+
+	servers := make([]ServerConfig, len(legacyServers))
+	for i, legacy := range legacyServers {
+		routes := sharedRoutes
+		if routes == nil {
+			routes = trivialRouteTable(legacy.UpstreamURL)
+		}
+		servers[i] = ServerConfig{Port: legacy.Port, Routes: routes}
+	}
+
+	return servers, nil
+}
+
+// loadRouteTable builds the RouteTable from ROUTES_FILE (JSON) or ROUTES
+// (compact env format), preferring ROUTES_FILE when both are set. It
+// returns nil when neither is configured, signaling that callers should
+// fall back to the legacy per-port trivial routing shim.
+func loadRouteTable() (*RouteTable, error) {
+	if routesFile := os.Getenv("ROUTES_FILE"); routesFile != "" {
+		routes, err := parseRoutesFile(routesFile)
+		if err != nil {
+			return nil, err
+		}
+		return newRouteTable(routes), nil
+	}
+
+	routes, err := parseRoutesEnv(os.Getenv("ROUTES"))
+	if err != nil {
+		return nil, err
+	}
+	if routes == nil {
+		return nil, nil
+	}
+	return newRouteTable(routes), nil
+}
+
+// parseRoutesFile reads ROUTES_FILE and decodes it as a JSON array of
+// Route. (The repo has no YAML dependency, so only JSON is supported.)
+func parseRoutesFile(path string) ([]Route, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ROUTES_FILE: %w", err)
+	}
+
+	var routes []Route
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("failed to parse ROUTES_FILE as JSON: %w", err)
+	}
+	return routes, nil
+}
+
+// parseRoutesEnv parses the ROUTES environment variable.
+// Format: one route per ";"-separated entry, with "|"-separated fields:
+//
+//	HOST|PATH_PREFIX|UPSTREAM1,UPSTREAM2|STRATEGY|STRIP_PREFIX|CLAIM:VAL,CLAIM:VAL
+//
+// HOST may be empty to match any host. STRATEGY, STRIP_PREFIX and the
+// required-claims field are optional and default to round-robin, false,
+// and none, respectively.
+//
+// Example:
+//
+//	api.example.com|/api/|http://a:8080,http://b:8080|round-robin|true|role:admin
+func parseRoutesEnv(routesEnv string) ([]Route, error) {
+	if routesEnv == "" {
+		return nil, nil
+	}
+
+	var routes []Route
+	for _, entry := range strings.Split(routesEnv, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		fields := strings.Split(entry, "|")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid ROUTES entry: %s", entry)
+		}
+
+		route := Route{
+			Host:       strings.TrimSpace(fields[0]),
+			PathPrefix: strings.TrimSpace(fields[1]),
+		}
+
+		for _, upstream := range strings.Split(fields[2], ",") {
+			if trimmed := strings.TrimSpace(upstream); trimmed != "" {
+				route.Upstreams = append(route.Upstreams, trimmed)
+			}
+		}
+		if len(route.Upstreams) == 0 {
+			return nil, fmt.Errorf("invalid ROUTES entry, no upstreams: %s", entry)
+		}
+
+		if len(fields) > 3 {
+			route.Strategy = strings.TrimSpace(fields[3])
+		}
+		if len(fields) > 4 {
+			route.StripPrefix = strings.TrimSpace(fields[4]) == "true"
+		}
+		if len(fields) > 5 && strings.TrimSpace(fields[5]) != "" {
+			route.RequiredClaims = make(map[string]string)
+			for _, pair := range strings.Split(fields[5], ",") {
+				kv := strings.SplitN(pair, ":", 2)
+				if len(kv) != 2 {
+					return nil, fmt.Errorf("invalid required claim in ROUTES entry: %s", entry)
+				}
+				route.RequiredClaims[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+		}
+
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
 // parsePublicPaths parses the PUBLIC_PATHS environment variable
 func parsePublicPaths() []string {
 	publicPathsEnv := os.Getenv("PUBLIC_PATHS")
@@ -101,7 +293,7 @@ func parsePublicPaths() []string {
 
 // LoadConfig loads the application configuration from environment variables
 func LoadConfig() (*Config, error) {
-	servers, err := parseServers()
+	servers, err := buildServerConfigs()
 	if err != nil {
 		return nil, err
 	}
@@ -125,12 +317,142 @@ func LoadConfig() (*Config, error) {
 
 	publicPaths := parsePublicPaths()
 
+	oidcConfig, err := loadOIDCConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	mfaConfig, err := loadMFAConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	tokenRefreshURL := os.Getenv("TOKEN_REFRESH_URL")
+	if tokenRefreshURL == "" && oidcConfig != nil {
+		tokenRefreshURL = oidcConfig.TokenEndpoint
+	}
+
 	return &Config{
-		Servers:       servers,
-		RedirectURL:   redirectURL,
-		JWTTimeoutURL: jwtTimeoutURL,
-		JWTKeyPath:    jwtKeyPath,
-		JWTCookieName: jwtCookieName,
-		PublicPaths:   publicPaths,
+		Servers:         servers,
+		RedirectURL:     redirectURL,
+		JWTTimeoutURL:   jwtTimeoutURL,
+		JWTKeyPath:      jwtKeyPath,
+		JWTCookieName:   jwtCookieName,
+		PublicPaths:     publicPaths,
+		OIDC:            oidcConfig,
+		MFA:             mfaConfig,
+		MetricsAddr:     os.Getenv("METRICS_ADDR"),
+		WSMaxConnBytes:  parseWSMaxConnBytes(),
+		JWTClockSkew:    parseDurationEnv("JWT_CLOCK_SKEW", 1*time.Minute),
+		JWTMaxLifetime:  parseDurationEnv("JWT_MAX_LIFETIME", 24*time.Hour),
+		TokenRefreshURL: tokenRefreshURL,
 	}, nil
 }
+
+// parseDurationEnv parses name as a time.Duration (e.g. "90s", "24h"),
+// falling back to def if it's unset or invalid.
+func parseDurationEnv(name string, def time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// parseWSMaxConnBytes parses WS_MAX_CONN_BYTES, returning 0
+// (unlimited) if it's unset or invalid.
+func parseWSMaxConnBytes() int64 {
+	raw := os.Getenv("WS_MAX_CONN_BYTES")
+	if raw == "" {
+		return 0
+	}
+	max, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || max <= 0 {
+		return 0
+	}
+	return max
+}
+
+// oidcDiscoveryDocument is the subset of /.well-known/openid-configuration
+// fields the proxy needs to drive the authorization-code flow.
+type oidcDiscoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// loadOIDCConfig loads OIDC relying-party configuration and, if
+// OIDC_PROVIDER_URL is set, fetches the provider's discovery document.
+func loadOIDCConfig() (*OIDCConfig, error) {
+	providerURL := os.Getenv("OIDC_PROVIDER_URL")
+	if providerURL == "" {
+		return nil, nil
+	}
+
+	redirectPath := os.Getenv("OIDC_REDIRECT_PATH")
+	if redirectPath == "" {
+		redirectPath = "/oauth/callback"
+	}
+
+	scopesEnv := os.Getenv("OIDC_SCOPES")
+	if scopesEnv == "" {
+		scopesEnv = "openid,profile,email"
+	}
+	var scopes []string
+	for _, scope := range strings.Split(scopesEnv, ",") {
+		if trimmed := strings.TrimSpace(scope); trimmed != "" {
+			scopes = append(scopes, trimmed)
+		}
+	}
+
+	stateSecret := os.Getenv("OIDC_STATE_SECRET")
+	if stateSecret == "" {
+		return nil, fmt.Errorf("OIDC_STATE_SECRET must be set when OIDC_PROVIDER_URL is configured")
+	}
+
+	doc, err := fetchOIDCDiscoveryDocument(providerURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC discovery document: %w", err)
+	}
+
+	return &OIDCConfig{
+		ProviderURL:           providerURL,
+		ClientID:              os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:          os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectPath:          redirectPath,
+		Scopes:                scopes,
+		StateSecret:           []byte(stateSecret),
+		Issuer:                doc.Issuer,
+		AuthorizationEndpoint: doc.AuthorizationEndpoint,
+		TokenEndpoint:         doc.TokenEndpoint,
+		JWKSURI:               doc.JWKSURI,
+	}, nil
+}
+
+// fetchOIDCDiscoveryDocument fetches and parses the provider's
+// /.well-known/openid-configuration document.
+func fetchOIDCDiscoveryDocument(providerURL string) (*oidcDiscoveryDocument, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Get(strings.TrimRight(providerURL, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from discovery endpoint", resp.StatusCode)
+	}
+
+	var doc oidcDiscoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("failed to decode discovery document: %w", err)
+	}
+
+	return &doc, nil
+}
@@ -6,11 +6,8 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"os"
 	"os/signal"
@@ -23,16 +20,24 @@ import (
 )
 
 var (
-	jwtPublicKey interface{}
-	config       *Config
+	config               *Config
+	jwtValidatorInstance *jwtValidator
 )
 
 // Claims represents the JWT claims
 type Claims struct {
-	UserID string `json:"userId"`
-	Email  string `json:"email"`
-	Sub    string `json:"sub"`
+	UserID string   `json:"userId"`
+	Email  string   `json:"email"`
+	Sub    string   `json:"sub"`
+	Nonce  string   `json:"nonce,omitempty"`
+	Acr    string   `json:"acr,omitempty"`
+	Amr    []string `json:"amr,omitempty"`
 	jwt.RegisteredClaims
+
+	// Raw holds the full claim set as decoded from the token, so routing
+	// rules can gate on arbitrary claims (e.g. "role", "groups") that
+	// aren't modeled as dedicated fields above.
+	Raw jwt.MapClaims `json:"-"`
 }
 
 // parseCookies extracts cookies from the Cookie header
@@ -51,23 +56,6 @@ func parseCookies(cookieHeader string) map[string]string {
 	return cookies
 }
 
-// verifyJWT verifies the JWT token and returns the claims
-func verifyJWT(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtPublicKey, nil
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims, nil
-	}
-
-	return nil, fmt.Errorf("invalid token")
-}
-
 // isPublicPath checks if the given path matches any public path patterns
 func isPublicPath(path string) bool {
 	for _, publicPath := range config.PublicPaths {
@@ -78,215 +66,147 @@ func isPublicPath(path string) bool {
 	return false
 }
 
-// authMiddleware handles JWT verification
-func authMiddleware(next http.Handler) http.Handler {
+// authMiddleware handles JWT verification. routes is the route table for
+// this listener, consulted for route-level public paths and required
+// claims in addition to the global policy.
+func authMiddleware(next http.Handler, routes *RouteTable) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Check if path is public
-		if isPublicPath(r.URL.Path) {
-			next.ServeHTTP(w, r)
-			return
-		}
+		start := time.Now()
+		route, _, routeMatched := routes.match(r.Host, r.URL.Path)
 
-		// Get token from cookie
-		cookie, err := r.Cookie(config.JWTCookieName)
-		if err != nil {
-			log.Printf("No token found in cookie '%s', redirecting to %s", config.JWTCookieName, config.RedirectURL)
-			http.Redirect(w, r, config.RedirectURL, http.StatusFound)
+		// Check if path is public, globally or for the matched route
+		if isPublicPath(r.URL.Path) || (routeMatched && isRoutePublicPath(route, r.URL.Path)) {
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Verify JWT
-		claims, err := verifyJWT(cookie.Value)
-		if err != nil {
-			// Token exists but failed validation - redirect to JWT timeout/refresh URL
-			authURL := config.JWTTimeoutURL + url.QueryEscape(r.RequestURI)
-			log.Printf("JWT invalid, redirecting to %s", authURL)
-			http.Redirect(w, r, authURL, http.StatusFound)
+		// The OIDC login/callback endpoints are how unauthenticated
+		// requests become authenticated, so they must bypass auth too. The
+		// callback path is operator-configurable (OIDC_REDIRECT_PATH), so
+		// it's checked explicitly rather than assumed to share the
+		// "/oauth/" prefix the login endpoint is mounted under.
+		if config.OIDC != nil && (r.URL.Path == "/oauth/login" || r.URL.Path == config.OIDC.RedirectPath) {
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		// Store claims in context
-		ctx := context.WithValue(r.Context(), "claims", claims)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
-}
-
-// createReverseProxy creates a reverse proxy for the given target URL
-func createReverseProxy(targetURL string, port int) (*httputil.ReverseProxy, error) {
-	target, err := url.Parse(targetURL)
-	if err != nil {
-		return nil, err
-	}
-
-	proxy := httputil.NewSingleHostReverseProxy(target)
-
-	// Custom director to add user headers
-	originalDirector := proxy.Director
-	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
+		// Get token from cookie
+		cookie, cookieErr := r.Cookie(config.JWTCookieName)
 
-		// Add user information from claims if available
-		if claims, ok := req.Context().Value("claims").(*Claims); ok {
-			userID := claims.UserID
-			if userID == "" {
-				userID = claims.Sub
-			}
-			req.Header.Set("X-User-Id", userID)
-			req.Header.Set("X-User-Email", claims.Email)
+		var claims *Claims
+		if cookieErr == nil {
+			claims, _ = jwtValidatorInstance.VerifyJWT(cookie.Value)
 		}
 
-		log.Printf("[Port %d] Proxying %s %s to %s", port, req.Method, req.URL.Path, targetURL)
-	}
-
-	// Custom error handler
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("[Port %d] Proxy error: %v", port, err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadGateway)
-		fmt.Fprintf(w, `{"error":"Bad Gateway","message":"Failed to connect to upstream server"}`)
-	}
-
-	return proxy, nil
-}
-
-// healthCheckHandler returns a health check handler
-func healthCheckHandler(port int, upstreamURL string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"status":"ok","timestamp":"%s","port":%d,"upstream":"%s"}`,
-			time.Now().Format(time.RFC3339), port, upstreamURL)
-	}
-}
-
-// handleWebSocket handles WebSocket upgrade requests with JWT verification
-func handleWebSocket(proxy *httputil.ReverseProxy, port int, upstreamURL string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Check if it's a WebSocket upgrade request
-		if !isWebSocketUpgrade(r) {
-			proxy.ServeHTTP(w, r)
-			return
+		// Token missing or invalid - try a silent renewal via the
+		// refresh_token cookie before falling back to a browser redirect.
+		if claims == nil {
+			claims, _ = silentlyRenewSession(w, r)
 		}
 
-		// Check if path is public
-		if !isPublicPath(r.URL.Path) {
-			// Verify JWT for WebSocket connections
-			cookieHeader := r.Header.Get("Cookie")
-			cookies := parseCookies(cookieHeader)
-			token, ok := cookies[config.JWTCookieName]
-
-			if !ok {
-				log.Printf("WebSocket: No token found in cookie '%s'", config.JWTCookieName)
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if claims == nil {
+			// XHR/fetch callers can't follow a 302 to an HTML login page
+			// usefully; give them a machine-readable 401 to react to instead.
+			if wantsJSONAuthResponse(r) {
+				recordAuthDecision(r, start, "json-token-expired", nil)
+				respondTokenExpired(w)
 				return
 			}
 
-			claims, err := verifyJWT(token)
-			if err != nil {
-				log.Printf("WebSocket: JWT validation failed: %v", err)
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			if cookieErr != nil {
+				recordAuthDecision(r, start, "redirect-no-cookie", nil)
+				redirectToLogin(w, r)
 				return
 			}
-
-			// Store claims in context for the proxy
-			ctx := context.WithValue(r.Context(), "claims", claims)
-			r = r.WithContext(ctx)
-		}
-
-		log.Printf("[Port %d] Proxying WebSocket upgrade for %s to %s", port, r.URL.Path, upstreamURL)
-
-		// Hijack the connection
-		hijacker, ok := w.(http.Hijacker)
-		if !ok {
-			http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
-			return
-		}
-
-		// Parse target URL
-		target, err := url.Parse(upstreamURL)
-		if err != nil {
-			http.Error(w, "Invalid upstream URL", http.StatusInternalServerError)
-			return
-		}
-
-		// Connect to upstream
-		targetConn, err := net.Dial("tcp", target.Host)
-		if err != nil {
-			http.Error(w, "Failed to connect to upstream", http.StatusBadGateway)
-			return
-		}
-		defer targetConn.Close()
-
-		// Hijack client connection
-		clientConn, _, err := hijacker.Hijack()
-		if err != nil {
-			http.Error(w, "Failed to hijack connection", http.StatusInternalServerError)
+			// Token exists but failed validation - redirect to JWT timeout/refresh URL
+			authURL := config.JWTTimeoutURL + url.QueryEscape(r.RequestURI)
+			recordAuthDecision(r, start, "redirect-jwt-invalid", nil)
+			http.Redirect(w, r, authURL, http.StatusFound)
 			return
 		}
-		defer clientConn.Close()
 
-		// Modify request to include user headers
-		if claims, ok := r.Context().Value("claims").(*Claims); ok {
-			userID := claims.UserID
-			if userID == "" {
-				userID = claims.Sub
+		// Enforce MFA policy (ACR/AMR), if configured
+		if config.MFA != nil {
+			policy := config.MFA.policyForPath(r.URL.Path)
+			if !checkMFAPolicy(claims, policy) {
+				recordAuthDecision(r, start, "mfa-step-up", claims)
+				redirectToStepUpLogin(w, r, policy)
+				return
 			}
-			r.Header.Set("X-User-Id", userID)
-			r.Header.Set("X-User-Email", claims.Email)
 		}
 
-		// Write the upgrade request to upstream
-		err = r.Write(targetConn)
-		if err != nil {
-			log.Printf("Failed to write upgrade request: %v", err)
+		// Enforce the matched route's required claims (e.g. group/role gating)
+		if routeMatched && !routeClaimsSatisfied(route, claims) {
+			recordAuthDecision(r, start, "forbidden", claims)
+			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
 
-		// Copy data bidirectionally
-		var wg sync.WaitGroup
-		wg.Add(2)
-
-		go func() {
-			defer wg.Done()
-			io.Copy(targetConn, clientConn)
-		}()
+		recordAuthDecision(r, start, "allow", claims)
 
-		go func() {
-			defer wg.Done()
-			io.Copy(clientConn, targetConn)
-		}()
+		// Store claims in context
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
 
-		wg.Wait()
+// redirectToLogin sends the browser to the OIDC login endpoint when OIDC is
+// configured, or to the legacy RedirectURL otherwise.
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	if config.OIDC != nil {
+		loginURL := "/oauth/login?return_to=" + url.QueryEscape(r.RequestURI)
+		http.Redirect(w, r, loginURL, http.StatusFound)
+		return
 	}
+	http.Redirect(w, r, config.RedirectURL, http.StatusFound)
+}
+
+// wantsJSONAuthResponse reports whether the caller is an XHR/fetch request
+// that should get a machine-readable 401 instead of a browser redirect when
+// its session can't be authenticated.
+func wantsJSONAuthResponse(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") ||
+		r.Header.Get("X-Requested-With") == "XMLHttpRequest"
 }
 
-// isWebSocketUpgrade checks if the request is a WebSocket upgrade request
-func isWebSocketUpgrade(r *http.Request) bool {
-	return strings.ToLower(r.Header.Get("Connection")) == "upgrade" &&
-		strings.ToLower(r.Header.Get("Upgrade")) == "websocket"
+// respondTokenExpired writes the 401 JSON body wantsJSONAuthResponse
+// callers get in place of a login/JWT-timeout redirect.
+func respondTokenExpired(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprint(w, `{"error":"token_expired"}`)
+}
+
+// healthCheckHandler returns a health check handler
+func healthCheckHandler(port int, routes *RouteTable) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"status":"ok","timestamp":"%s","port":%d,"routes":%d}`,
+			time.Now().Format(time.RFC3339), port, len(routes.routes))
+	}
 }
 
 // startServer starts a server instance on the specified port
 func startServer(serverConfig ServerConfig, wg *sync.WaitGroup) *http.Server {
 	defer wg.Done()
 
-	// Create reverse proxy
-	proxy, err := createReverseProxy(serverConfig.UpstreamURL, serverConfig.Port)
-	if err != nil {
-		log.Fatalf("Failed to create proxy for port %d: %v", serverConfig.Port, err)
-	}
+	// Create the single reverse proxy shared by every route on this port
+	proxy := createRoutingProxy(serverConfig.Port)
 
 	// Create router
 	mux := http.NewServeMux()
 
 	// Health check endpoint (bypasses authentication)
-	mux.HandleFunc("/health", healthCheckHandler(serverConfig.Port, serverConfig.UpstreamURL))
+	mux.HandleFunc("/health", healthCheckHandler(serverConfig.Port, serverConfig.Routes))
 
-	// WebSocket and HTTP proxy handler with auth middleware
-	mux.HandleFunc("/", handleWebSocket(proxy, serverConfig.Port, serverConfig.UpstreamURL))
+	// OIDC login/callback endpoints, when configured
+	mountOIDCRoutes(mux)
 
-	// Apply auth middleware to all routes
-	handler := authMiddleware(mux)
+	// Route dispatch handler (HTTP proxying, load balancing, and WebSocket
+	// upgrades) with auth middleware
+	mux.HandleFunc("/", routeDispatchHandler(serverConfig.Port, serverConfig.Routes, proxy))
+	handler := withRequestID(authMiddleware(mux, serverConfig.Routes))
 
 	// Create server
 	server := &http.Server{
@@ -300,7 +220,7 @@ func startServer(serverConfig ServerConfig, wg *sync.WaitGroup) *http.Server {
 	// Start server in a goroutine
 	go func() {
 		log.Printf("Reverse Auth Proxy running on port %d", serverConfig.Port)
-		log.Printf("  -> Proxying to: %s", serverConfig.UpstreamURL)
+		log.Printf("  -> Routes configured: %d", len(serverConfig.Routes.routes))
 		log.Printf("  -> Redirect URL: %s", config.RedirectURL)
 		log.Printf("  -> JWT Cookie: %s", config.JWTCookieName)
 		log.Printf("  -> WebSocket support: enabled")
@@ -359,16 +279,31 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	// Load JWT key
-	if config.JWTKeyPath == "" {
-		log.Fatal("ERROR: JWT_KEY_PATH is not configured. Please set it in your environment variables.")
+	// Set up JWT verification: a JWKS-backed validator when OIDC is
+	// configured (so IdP key rotation needs no restart), otherwise the
+	// legacy static key file.
+	if config.OIDC != nil {
+		jwtValidatorInstance = newJWKSJWTValidator(config.OIDC, config.JWTClockSkew, config.JWTMaxLifetime)
+		log.Printf("OIDC enabled, verifying tokens against JWKS at: %s", config.OIDC.JWKSURI)
+	} else {
+		if config.JWTKeyPath == "" {
+			log.Fatal("ERROR: JWT_KEY_PATH is not configured. Please set it in your environment variables.")
+		}
+
+		jwtPublicKey, err := loadJWTKey(config.JWTKeyPath)
+		if err != nil {
+			log.Fatalf("ERROR: Failed to load JWT key from %s: %v", config.JWTKeyPath, err)
+		}
+		jwtValidatorInstance = newStaticJWTValidator(jwtPublicKey, config.JWTClockSkew)
+		jwtValidatorInstance.maxLifetime = config.JWTMaxLifetime
+		log.Printf("Loaded JWT key from: %s", config.JWTKeyPath)
 	}
 
-	jwtPublicKey, err = loadJWTKey(config.JWTKeyPath)
-	if err != nil {
-		log.Fatalf("ERROR: Failed to load JWT key from %s: %v", config.JWTKeyPath, err)
+	// Start the metrics admin listener, if configured
+	var metricsServer *http.Server
+	if config.MetricsAddr != "" {
+		metricsServer = startMetricsServer(config.MetricsAddr)
 	}
-	log.Printf("Loaded JWT key from: %s", config.JWTKeyPath)
 
 	// Start all servers
 	var wg sync.WaitGroup
@@ -398,5 +333,11 @@ func main() {
 		}
 	}
 
+	if metricsServer != nil {
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			log.Printf("Metrics server shutdown error: %v", err)
+		}
+	}
+
 	log.Println("All servers stopped")
 }
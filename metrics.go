@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default histogram buckets for proxy_request_duration_seconds, modeled on
+// the Prometheus client library's DefBuckets.
+var defaultLatencyBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+// metricsRegistry is a minimal, dependency-free stand-in for a Prometheus
+// client: it tracks the counters/histogram this proxy exposes and renders
+// them in the Prometheus text exposition format on /metrics.
+type metricsRegistry struct {
+	authDecisionsTotal   *counterVec
+	proxyRequestsTotal   *counterVec
+	proxyRequestDuration *histogram
+	jwksRefreshTotal     *counterVec
+	tokenRefreshTotal    *counterVec
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		authDecisionsTotal:   newCounterVec("auth_decisions_total", "Total number of auth decisions by outcome", "outcome"),
+		proxyRequestsTotal:   newCounterVec("proxy_requests_total", "Total number of proxied requests", "port", "upstream", "code"),
+		proxyRequestDuration: newHistogram("proxy_request_duration_seconds", "Proxied request duration in seconds", defaultLatencyBuckets),
+		jwksRefreshTotal:     newCounterVec("jwks_refresh_total", "Total number of JWKS refresh attempts by result", "result"),
+		tokenRefreshTotal:    newCounterVec("token_refresh_total", "Total number of silent session renewals via refresh_token by result", "result"),
+	}
+}
+
+// metrics is the process-wide metrics registry, populated by the audit
+// subsystem as auth decisions and proxy requests happen.
+var metrics = newMetricsRegistry()
+
+// WriteTo renders every metric in the registry in Prometheus text
+// exposition format.
+func (m *metricsRegistry) WriteTo(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.authDecisionsTotal.writeTo(w)
+	m.proxyRequestsTotal.writeTo(w)
+	m.proxyRequestDuration.writeTo(w)
+	m.jwksRefreshTotal.writeTo(w)
+	m.tokenRefreshTotal.writeTo(w)
+}
+
+// counterVec is a counter partitioned by a fixed set of label names.
+type counterVec struct {
+	name       string
+	help       string
+	labelNames []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labelNames ...string) *counterVec {
+	return &counterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     make(map[string]float64),
+	}
+}
+
+// inc increments the counter for the given label values, which must be
+// supplied in the same order as labelNames.
+func (c *counterVec) inc(labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) writeTo(w http.ResponseWriter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, labelString(c.labelNames, strings.Split(key, "\x00")), c.values[key])
+	}
+}
+
+// histogram is a cumulative latency histogram with fixed buckets.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu            sync.Mutex
+	bucketCounts  []uint64
+	sum           float64
+	count         uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:         name,
+		help:         help,
+		buckets:      buckets,
+		bucketCounts: make([]uint64, len(buckets)),
+	}
+}
+
+// observe records a single duration, in seconds.
+func (h *histogram) observe(seconds float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			h.bucketCounts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (h *histogram) writeTo(w http.ResponseWriter) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", h.name, h.help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", h.name)
+
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, bound, h.bucketCounts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", h.name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// labelString renders label names/values as Prometheus's {a="b",c="d"} syntax.
+func labelString(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		fmt.Fprintf(&b, "%s=%q", name, value)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// startMetricsServer starts the admin listener serving /metrics, when
+// METRICS_ADDR is configured.
+func startMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		metrics.WriteTo(w)
+	})
+
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+	}
+
+	go func() {
+		log.Printf("Metrics server running on %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Metrics server failed: %v", err)
+		}
+	}()
+
+	return server
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Recognized AMR (Authentication Methods Reference) values, per the
+// standard vocabulary in RFC 8176.
+const (
+	AMRPassword = "pas" // password
+	AMROTP      = "otp" // one-time password
+	AMRU2F      = "u2f" // universal 2nd factor / WebAuthn
+	AMRMFA      = "mfa" // generic multi-factor
+	AMRHRD      = "hrd" // home realm discovery
+	AMRSoftware = "sft" // software token / soft key
+)
+
+// RecognizedAMRValues lists the AMR values this proxy understands when
+// validating REQUIRED_AMR/ALLOWED_AMR/MFA_PATHS configuration.
+var RecognizedAMRValues = []string{AMRPassword, AMROTP, AMRU2F, AMRMFA, AMRHRD, AMRSoftware}
+
+// MFAPolicy describes the authentication strength a request must present.
+type MFAPolicy struct {
+	// RequiredAMR is an AND-set: every value must be present in the
+	// token's amr claim.
+	RequiredAMR []string
+	// AllowedAMR is an OR-set: at least one value must be present.
+	AllowedAMR []string
+	// ACRValues are acceptable acr claim values; if set, the token's acr
+	// must match one of them.
+	ACRValues []string
+}
+
+// isZero reports whether the policy has no constraints at all.
+func (p MFAPolicy) isZero() bool {
+	return len(p.RequiredAMR) == 0 && len(p.AllowedAMR) == 0 && len(p.ACRValues) == 0
+}
+
+// mfaPathOverride binds a stronger (or different) MFAPolicy to requests
+// whose path starts with PathPrefix.
+type mfaPathOverride struct {
+	PathPrefix string
+	Policy     MFAPolicy
+}
+
+// MFAConfig holds the default MFA policy plus any per-path overrides,
+// e.g. MFA_PATHS=/admin:mfa+otp,/billing:u2f.
+type MFAConfig struct {
+	Default       MFAPolicy
+	PathOverrides []mfaPathOverride
+}
+
+// policyForPath returns the MFA policy that applies to path: the first
+// matching per-path override, or the default policy.
+func (c *MFAConfig) policyForPath(path string) MFAPolicy {
+	for _, override := range c.PathOverrides {
+		if strings.HasPrefix(path, override.PathPrefix) {
+			return override.Policy
+		}
+	}
+	return c.Default
+}
+
+// loadMFAConfig parses REQUIRED_AMR, ALLOWED_AMR, ACR_VALUES and MFA_PATHS.
+// It returns nil if none of them are set, meaning MFA enforcement is
+// disabled entirely.
+func loadMFAConfig() (*MFAConfig, error) {
+	requiredAMR := splitAndTrim(os.Getenv("REQUIRED_AMR"))
+	allowedAMR := splitAndTrim(os.Getenv("ALLOWED_AMR"))
+	acrValues := splitAndTrim(os.Getenv("ACR_VALUES"))
+
+	if err := validateAMRValues("REQUIRED_AMR", requiredAMR); err != nil {
+		return nil, err
+	}
+	if err := validateAMRValues("ALLOWED_AMR", allowedAMR); err != nil {
+		return nil, err
+	}
+
+	pathOverrides, err := parseMFAPaths(os.Getenv("MFA_PATHS"))
+	if err != nil {
+		return nil, err
+	}
+
+	defaultPolicy := MFAPolicy{
+		RequiredAMR: requiredAMR,
+		AllowedAMR:  allowedAMR,
+		ACRValues:   acrValues,
+	}
+
+	if defaultPolicy.isZero() && len(pathOverrides) == 0 {
+		return nil, nil
+	}
+
+	return &MFAConfig{
+		Default:       defaultPolicy,
+		PathOverrides: pathOverrides,
+	}, nil
+}
+
+// parseMFAPaths parses the MFA_PATHS environment variable.
+// Format: PATH:AMR+AMR,PATH:AMR,...
+// Example: /admin:mfa+otp,/billing:u2f
+func parseMFAPaths(mfaPathsEnv string) ([]mfaPathOverride, error) {
+	if mfaPathsEnv == "" {
+		return nil, nil
+	}
+
+	var overrides []mfaPathOverride
+	for _, entry := range strings.Split(mfaPathsEnv, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid MFA_PATHS entry: %s", entry)
+		}
+
+		path := strings.TrimSpace(parts[0])
+		amrValues := splitAndTrim(strings.ReplaceAll(parts[1], "+", ","))
+		if path == "" || len(amrValues) == 0 {
+			return nil, fmt.Errorf("invalid MFA_PATHS entry: %s", entry)
+		}
+		if err := validateAMRValues("MFA_PATHS", amrValues); err != nil {
+			return nil, err
+		}
+
+		overrides = append(overrides, mfaPathOverride{
+			PathPrefix: path,
+			Policy:     MFAPolicy{RequiredAMR: amrValues},
+		})
+	}
+
+	return overrides, nil
+}
+
+// validateAMRValues rejects any value in values that isn't in
+// RecognizedAMRValues, so a typo (REQUIRED_AMR=otpp) fails fast at startup
+// instead of silently configuring a policy no token can ever satisfy.
+func validateAMRValues(envVar string, values []string) error {
+	for _, v := range values {
+		recognized := false
+		for _, known := range RecognizedAMRValues {
+			if v == known {
+				recognized = true
+				break
+			}
+		}
+		if !recognized {
+			return fmt.Errorf("%s: unrecognized AMR value %q (recognized: %s)", envVar, v, strings.Join(RecognizedAMRValues, ", "))
+		}
+	}
+	return nil
+}
+
+// splitAndTrim splits a comma-separated list and drops empty entries.
+func splitAndTrim(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var result []string
+	for _, part := range strings.Split(s, ",") {
+		if trimmed := strings.TrimSpace(part); trimmed != "" {
+			result = append(result, trimmed)
+		}
+	}
+	return result
+}
+
+// checkMFAPolicy reports whether claims satisfy policy.
+func checkMFAPolicy(claims *Claims, policy MFAPolicy) bool {
+	amrSet := make(map[string]bool, len(claims.Amr))
+	for _, amr := range claims.Amr {
+		amrSet[amr] = true
+	}
+
+	for _, required := range policy.RequiredAMR {
+		if !amrSet[required] {
+			return false
+		}
+	}
+
+	if len(policy.AllowedAMR) > 0 {
+		satisfied := false
+		for _, allowed := range policy.AllowedAMR {
+			if amrSet[allowed] {
+				satisfied = true
+				break
+			}
+		}
+		if !satisfied {
+			return false
+		}
+	}
+
+	if len(policy.ACRValues) > 0 {
+		satisfied := false
+		for _, acr := range policy.ACRValues {
+			if claims.Acr == acr {
+				satisfied = true
+				break
+			}
+		}
+		if !satisfied {
+			return false
+		}
+	}
+
+	return true
+}
+
+// redirectToStepUpLogin sends the browser back to the IdP requesting a
+// stronger authentication context (acr_values) and a fresh login
+// (prompt=login), rather than just bouncing to RedirectURL. When OIDC isn't
+// configured there is no IdP to ask, and it redirects to RedirectURL.
+func redirectToStepUpLogin(w http.ResponseWriter, r *http.Request, policy MFAPolicy) {
+	if config.OIDC == nil {
+		log.Printf("MFA policy not satisfied for %s, but OIDC is not configured; redirecting to %s", r.URL.Path, config.RedirectURL)
+		http.Redirect(w, r, config.RedirectURL, http.StatusFound)
+		return
+	}
+
+	extraParams := map[string]string{"prompt": "login"}
+	acrValues := policy.ACRValues
+	if len(acrValues) == 0 {
+		acrValues = policy.RequiredAMR
+	}
+	if len(acrValues) > 0 {
+		extraParams["acr_values"] = strings.Join(acrValues, " ")
+	}
+
+	authURL, err := buildAuthorizationRedirect(w, r, r.RequestURI, extraParams)
+	if err != nil {
+		http.Error(w, "Failed to start step-up login", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("MFA policy not satisfied for %s, redirecting to step-up login", r.URL.Path)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestCheckMFAPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy MFAPolicy
+		claims *Claims
+		want   bool
+	}{
+		{
+			name:   "zero policy always satisfied",
+			policy: MFAPolicy{},
+			claims: &Claims{},
+			want:   true,
+		},
+		{
+			name:   "required AMR present",
+			policy: MFAPolicy{RequiredAMR: []string{AMRMFA, AMROTP}},
+			claims: &Claims{Amr: []string{AMRPassword, AMRMFA, AMROTP}},
+			want:   true,
+		},
+		{
+			name:   "required AMR missing one value",
+			policy: MFAPolicy{RequiredAMR: []string{AMRMFA, AMROTP}},
+			claims: &Claims{Amr: []string{AMRMFA}},
+			want:   false,
+		},
+		{
+			name:   "allowed AMR satisfied by one value",
+			policy: MFAPolicy{AllowedAMR: []string{AMROTP, AMRU2F}},
+			claims: &Claims{Amr: []string{AMRU2F}},
+			want:   true,
+		},
+		{
+			name:   "allowed AMR satisfied by none",
+			policy: MFAPolicy{AllowedAMR: []string{AMROTP, AMRU2F}},
+			claims: &Claims{Amr: []string{AMRPassword}},
+			want:   false,
+		},
+		{
+			name:   "acr value matches",
+			policy: MFAPolicy{ACRValues: []string{"urn:mfa:high"}},
+			claims: &Claims{Acr: "urn:mfa:high"},
+			want:   true,
+		},
+		{
+			name:   "acr value mismatch",
+			policy: MFAPolicy{ACRValues: []string{"urn:mfa:high"}},
+			claims: &Claims{Acr: "urn:mfa:low"},
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkMFAPolicy(tt.claims, tt.policy); got != tt.want {
+				t.Errorf("checkMFAPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAMRValues(t *testing.T) {
+	if err := validateAMRValues("REQUIRED_AMR", []string{AMROTP, AMRMFA}); err != nil {
+		t.Errorf("expected recognized values to pass, got %v", err)
+	}
+	if err := validateAMRValues("REQUIRED_AMR", []string{"otpp"}); err == nil {
+		t.Error("expected an error for an unrecognized AMR value, got nil")
+	}
+}
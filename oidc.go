@@ -0,0 +1,718 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcStateCookieName   = "sso_rfp"
+	oidcNonceCookieName   = "sso_token"
+	oidcRefreshCookieName = "sso_rft"
+	oidcStateMaxAge       = 10 * time.Minute
+
+	// oidcRefreshCookieMaxAge is the sliding inactivity window for a
+	// refresh_token cookie: every silent renewal resets it, so an actively
+	// used session stays signed in, but 30 days without a renewal forces a
+	// full login again, independent of whatever lifetime the IdP itself
+	// applies to the refresh_token.
+	oidcRefreshCookieMaxAge = 30 * 24 * time.Hour
+)
+
+// jsonWebKey is the subset of RFC 7517 JWK fields needed to reconstruct an
+// RSA public key for JWT signature verification.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// jwksFetcher periodically refreshes a JWKS document and serves public keys
+// by `kid`, so key rotation on the IdP side doesn't require a restart.
+type jwksFetcher struct {
+	jwksURI string
+
+	mu      sync.RWMutex
+	keys    map[string]*rsa.PublicKey
+	expires time.Time
+}
+
+func newJWKSFetcher(jwksURI string) *jwksFetcher {
+	return &jwksFetcher{
+		jwksURI: jwksURI,
+		keys:    make(map[string]*rsa.PublicKey),
+	}
+}
+
+// keyForKID returns the public key for the given kid, refreshing the JWKS
+// document first if it has expired.
+func (f *jwksFetcher) keyForKID(kid string) (*rsa.PublicKey, error) {
+	f.mu.RLock()
+	key, ok := f.keys[kid]
+	expired := time.Now().After(f.expires)
+	f.mu.RUnlock()
+
+	if ok && !expired {
+		return key, nil
+	}
+
+	if err := f.refresh(); err != nil {
+		if ok {
+			// Serve the stale key rather than fail a request outright if
+			// the IdP is temporarily unreachable.
+			return key, nil
+		}
+		return nil, err
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	key, ok = f.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("no JWKS key found for kid %q", kid)
+	}
+	return key, nil
+}
+
+// refresh fetches the JWKS document and replaces the cached key set,
+// honoring the response's Cache-Control/Expires headers for the next
+// refresh interval.
+func (f *jwksFetcher) refresh() error {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Get(f.jwksURI)
+	if err != nil {
+		recordJWKSRefresh("error")
+		return fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		recordJWKSRefresh("error")
+		return fmt.Errorf("unexpected status %d fetching JWKS", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		recordJWKSRefresh("error")
+		return fmt.Errorf("failed to read JWKS response: %w", err)
+	}
+
+	var jwks jsonWebKeySet
+	if err := json.Unmarshal(body, &jwks); err != nil {
+		recordJWKSRefresh("error")
+		return fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || jwk.Kid == "" {
+			continue
+		}
+		pubKey, err := rsaPublicKeyFromJWK(jwk)
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = pubKey
+	}
+
+	f.mu.Lock()
+	f.keys = keys
+	f.expires = time.Now().Add(jwksRefreshInterval(resp.Header))
+	f.mu.Unlock()
+
+	recordJWKSRefresh("success")
+	return nil
+}
+
+// jwksRefreshInterval derives the next refresh time from Cache-Control's
+// max-age or the Expires header, falling back to a conservative default.
+func jwksRefreshInterval(header http.Header) time.Duration {
+	const defaultInterval = 15 * time.Minute
+
+	if cacheControl := header.Get("Cache-Control"); cacheControl != "" {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			directive = strings.TrimSpace(directive)
+			if strings.HasPrefix(directive, "max-age=") {
+				seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+				if err == nil && seconds > 0 {
+					return time.Duration(seconds) * time.Second
+				}
+			}
+		}
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			if d := time.Until(t); d > 0 {
+				return d
+			}
+		}
+	}
+
+	return defaultInterval
+}
+
+// rsaPublicKeyFromJWK reconstructs an RSA public key from its base64url-
+// encoded modulus (n) and exponent (e).
+func rsaPublicKeyFromJWK(jwk jsonWebKey) (*rsa.PublicKey, error) {
+	nBytes, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %w", err)
+	}
+	eBytes, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %w", err)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nBytes),
+		E: int(new(big.Int).SetBytes(eBytes).Int64()),
+	}, nil
+}
+
+// jwtValidator verifies JWTs either against a static key (legacy
+// JWT_KEY_PATH deployments) or against a JWKS-backed key set selected by
+// the token's `kid` header (OIDC deployments).
+type jwtValidator struct {
+	staticKey interface{}
+	jwks      *jwksFetcher
+
+	issuer      string
+	audience    string
+	clockSkew   time.Duration
+	maxLifetime time.Duration
+}
+
+func newStaticJWTValidator(key interface{}, clockSkew time.Duration) *jwtValidator {
+	return &jwtValidator{staticKey: key, clockSkew: clockSkew}
+}
+
+func newJWKSJWTValidator(oidc *OIDCConfig, clockSkew, maxLifetime time.Duration) *jwtValidator {
+	return &jwtValidator{
+		jwks:        newJWKSFetcher(oidc.JWKSURI),
+		issuer:      oidc.Issuer,
+		audience:    oidc.ClientID,
+		clockSkew:   clockSkew,
+		maxLifetime: maxLifetime,
+	}
+}
+
+// VerifyJWT parses and verifies the token string, selecting the signing key
+// by `kid` when backed by a JWKS, and enforces issuer, audience, clock skew
+// and maximum lifetime when configured.
+func (v *jwtValidator) VerifyJWT(tokenString string) (*Claims, error) {
+	parserOpts := []jwt.ParserOption{jwt.WithLeeway(v.clockSkew)}
+	if v.issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(v.issuer))
+	}
+	if v.audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(v.audience))
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		if v.jwks != nil {
+			kid, _ := token.Header["kid"].(string)
+			if kid == "" {
+				return nil, fmt.Errorf("token has no kid header")
+			}
+			return v.jwks.keyForKID(kid)
+		}
+		return v.staticKey, nil
+	}, parserOpts...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	if v.maxLifetime > 0 && claims.IssuedAt != nil {
+		if time.Since(claims.IssuedAt.Time) > v.maxLifetime {
+			return nil, fmt.Errorf("token exceeds maximum lifetime")
+		}
+	}
+
+	// The token was already verified above; this second, unverified parse
+	// just recovers the full claim set for routing rules that gate on
+	// claims not modeled as dedicated Claims fields.
+	var raw jwt.MapClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, &raw); err == nil {
+		claims.Raw = raw
+	}
+
+	return claims, nil
+}
+
+// signOIDCValue produces a value.hex(hmac) pair so state and nonce cookies
+// can't be forged or replayed with a different value.
+func signOIDCValue(secret []byte, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+	sig := hex.EncodeToString(mac.Sum(nil))
+	return value + "." + sig
+}
+
+// verifyOIDCValue checks a signed value produced by signOIDCValue and
+// returns the original value.
+func verifyOIDCValue(secret []byte, signed string) (string, bool) {
+	// value itself (e.g. "state|returnTo") routinely contains dots - any
+	// request path with a file extension or version segment has one - so
+	// split on the *last* dot, where the fixed-length hex signature lives,
+	// rather than the first.
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	value, sig := signed[:i], signed[i+1:]
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return "", false
+	}
+	return value, true
+}
+
+// randomOIDCToken returns a URL-safe random token used for the nonce and
+// request-forgery-protection (state) values.
+func randomOIDCToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// isLocalRedirectPath reports whether path is safe to redirect the browser
+// to after login: a path on this host, not an absolute or scheme-relative
+// URL that could bounce an authenticated browser to an attacker-controlled
+// site (CWE-601). "/billing" is fine; "//evil.example.com" and
+// "https://evil.example.com" are not. A leading backslash is rejected too,
+// since some browsers normalize it to "/", turning "/\evil.example.com"
+// into the scheme-relative form it's meant to block.
+func isLocalRedirectPath(path string) bool {
+	if path == "" || path[0] != '/' {
+		return false
+	}
+	if strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return false
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" && u.Host == ""
+}
+
+// handleOIDCLogin redirects the browser to the IdP's authorization endpoint,
+// storing a nonce and a request-forgery-protection (state) value in signed
+// cookies so the callback can validate them.
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	returnTo := r.URL.Query().Get("return_to")
+	if !isLocalRedirectPath(returnTo) {
+		returnTo = "/"
+	}
+
+	authURL, err := buildAuthorizationRedirect(w, r, returnTo, nil)
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("OIDC: redirecting to %s", config.OIDC.AuthorizationEndpoint)
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// buildAuthorizationRedirect issues fresh nonce/state cookies and builds the
+// IdP authorization URL for returnTo, merging in any extraParams (used by
+// the MFA step-up flow to add acr_values/prompt).
+func buildAuthorizationRedirect(w http.ResponseWriter, r *http.Request, returnTo string, extraParams map[string]string) (string, error) {
+	oidc := config.OIDC
+
+	nonce, err := randomOIDCToken()
+	if err != nil {
+		return "", err
+	}
+	state, err := randomOIDCToken()
+	if err != nil {
+		return "", err
+	}
+
+	// The return-to path rides along with the state so the callback knows
+	// where to send the browser once tokens are issued.
+	stateValue := state + "|" + returnTo
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcNonceCookieName,
+		Value:    signOIDCValue(oidc.StateSecret, nonce),
+		Path:     "/",
+		MaxAge:   int(oidcStateMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    signOIDCValue(oidc.StateSecret, stateValue),
+		Path:     "/",
+		MaxAge:   int(oidcStateMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	authURL, err := url.Parse(oidc.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	query := authURL.Query()
+	query.Set("client_id", oidc.ClientID)
+	query.Set("response_type", "code")
+	query.Set("redirect_uri", oidcRedirectURI(r, oidc))
+	query.Set("scope", strings.Join(oidc.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	for key, value := range extraParams {
+		query.Set(key, value)
+	}
+	authURL.RawQuery = query.Encode()
+
+	return authURL.String(), nil
+}
+
+// handleOIDCCallback exchanges the authorization code for tokens, verifies
+// the id_token against the IdP's JWKS, and re-issues it as the local
+// JWTCookieName cookie.
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	oidc := config.OIDC
+
+	queryState := r.URL.Query().Get("state")
+	code := r.URL.Query().Get("code")
+	if queryState == "" || code == "" {
+		http.Error(w, "Missing code or state", http.StatusBadRequest)
+		return
+	}
+
+	stateCookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil {
+		http.Error(w, "Missing state cookie", http.StatusBadRequest)
+		return
+	}
+	stateValue, ok := verifyOIDCValue(oidc.StateSecret, stateCookie.Value)
+	if !ok {
+		http.Error(w, "Invalid state cookie", http.StatusBadRequest)
+		return
+	}
+	parts := strings.SplitN(stateValue, "|", 2)
+	if len(parts) != 2 || parts[0] != queryState {
+		http.Error(w, "State mismatch", http.StatusBadRequest)
+		return
+	}
+	returnTo := parts[1]
+	if !isLocalRedirectPath(returnTo) {
+		// The state cookie is HMAC-signed by us, so return_to is whatever
+		// we stored: a path handleOIDCLogin checked, or the raw request URI
+		// the MFA step-up redirect passes without that check - fail closed
+		// rather than follow a non-local one.
+		http.Error(w, "Invalid return_to", http.StatusBadRequest)
+		return
+	}
+
+	nonceCookie, err := r.Cookie(oidcNonceCookieName)
+	if err != nil {
+		http.Error(w, "Missing nonce cookie", http.StatusBadRequest)
+		return
+	}
+	nonce, ok := verifyOIDCValue(oidc.StateSecret, nonceCookie.Value)
+	if !ok {
+		http.Error(w, "Invalid nonce cookie", http.StatusBadRequest)
+		return
+	}
+
+	clearOIDCCookies(w, r)
+
+	tokens, err := exchangeOIDCCode(oidc, code, oidcRedirectURI(r, oidc))
+	if err != nil {
+		log.Printf("OIDC: token exchange failed: %v", err)
+		http.Error(w, "Token exchange failed", http.StatusBadGateway)
+		return
+	}
+
+	claims, err := jwtValidatorInstance.VerifyJWT(tokens.IDToken)
+	if err != nil {
+		log.Printf("OIDC: id_token verification failed: %v", err)
+		http.Error(w, "Invalid id_token", http.StatusBadGateway)
+		return
+	}
+	if claims.Nonce != nonce {
+		log.Printf("OIDC: nonce mismatch")
+		http.Error(w, "Invalid id_token", http.StatusBadGateway)
+		return
+	}
+
+	setOIDCSessionCookies(w, r, tokens)
+
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// setOIDCSessionCookies re-issues the id_token as the local JWTCookieName
+// cookie and, when the IdP returned one, stashes the refresh_token so
+// authMiddleware can silently renew the session once the id_token expires.
+func setOIDCSessionCookies(w http.ResponseWriter, r *http.Request, tokens *oidcTokenResponse) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     config.JWTCookieName,
+		Value:    tokens.IDToken,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if tokens.RefreshToken == "" {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcRefreshCookieName,
+		Value:    tokens.RefreshToken,
+		Path:     "/",
+		MaxAge:   int(oidcRefreshCookieMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearRefreshCookie expires the refresh_token cookie, used when a silent
+// renewal attempt fails so a stale or revoked token isn't retried forever.
+func clearRefreshCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcRefreshCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearOIDCCookies expires the transient nonce/state cookies once the
+// callback has consumed them.
+func clearOIDCCookies(w http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{oidcNonceCookieName, oidcStateCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+// oidcTokenResponse is the subset of the token endpoint's JSON response the
+// proxy needs.
+type oidcTokenResponse struct {
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// exchangeOIDCCode performs the authorization_code grant against the IdP's
+// token endpoint.
+func exchangeOIDCCode(oidc *OIDCConfig, code, redirectURI string) (*oidcTokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", oidc.ClientID)
+	form.Set("client_secret", oidc.ClientSecret)
+
+	return postOIDCTokenForm(oidc.TokenEndpoint, form)
+}
+
+// refreshOIDCToken performs the refresh_token grant against
+// config.TokenRefreshURL to silently renew a session without involving the
+// browser. It doesn't require OIDC to be configured - legacy JWT_KEY_PATH
+// deployments can set TOKEN_REFRESH_URL on their own - but includes the
+// OIDC client credentials when OIDC is configured, since most IdPs expect
+// them on the refresh_token grant too.
+func refreshOIDCToken(refreshToken string) (*oidcTokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	if config.OIDC != nil {
+		form.Set("client_id", config.OIDC.ClientID)
+		form.Set("client_secret", config.OIDC.ClientSecret)
+	}
+
+	return postOIDCTokenForm(config.TokenRefreshURL, form)
+}
+
+// refreshSingleflight deduplicates concurrent silent renewals that present
+// the same refresh_token: against an IdP that rotates/single-uses refresh
+// tokens, several requests racing in right after an id_token expires would
+// otherwise redeem it in parallel, and all but the first would get an
+// invalid_grant error and force their caller to a full login. Unlike a
+// single mutex around the whole grant, callers for *different* tokens never
+// wait on each other - only callers sharing one token join its in-flight
+// call and share its result.
+var refreshSingleflight = struct {
+	mu    sync.Mutex
+	calls map[string]*refreshCall
+}{calls: make(map[string]*refreshCall)}
+
+type refreshCall struct {
+	wg     sync.WaitGroup
+	tokens *oidcTokenResponse
+	err    error
+}
+
+// refreshOIDCTokenOnce is refreshOIDCToken, deduplicated per refresh_token
+// via refreshSingleflight.
+func refreshOIDCTokenOnce(refreshToken string) (*oidcTokenResponse, error) {
+	refreshSingleflight.mu.Lock()
+	if call, inFlight := refreshSingleflight.calls[refreshToken]; inFlight {
+		refreshSingleflight.mu.Unlock()
+		call.wg.Wait()
+		return call.tokens, call.err
+	}
+
+	call := &refreshCall{}
+	call.wg.Add(1)
+	refreshSingleflight.calls[refreshToken] = call
+	refreshSingleflight.mu.Unlock()
+
+	call.tokens, call.err = refreshOIDCToken(refreshToken)
+
+	refreshSingleflight.mu.Lock()
+	delete(refreshSingleflight.calls, refreshToken)
+	refreshSingleflight.mu.Unlock()
+	call.wg.Done()
+
+	return call.tokens, call.err
+}
+
+// postOIDCTokenForm posts form to endpoint and decodes the resulting token
+// response, shared by the authorization_code and refresh_token grants.
+func postOIDCTokenForm(endpoint string, form url.Values) (*oidcTokenResponse, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.PostForm(endpoint, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, string(body))
+	}
+
+	var tokens oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("failed to decode token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("token response missing id_token")
+	}
+
+	return &tokens, nil
+}
+
+// silentlyRenewSession attempts to refresh an expired or otherwise invalid
+// session from the refresh_token cookie, without redirecting the browser
+// through the IdP. It returns the verified claims and true on success; on
+// any failure (no refresh URL or refresh cookie, IdP rejected it, renewed
+// id_token doesn't verify) it returns false so the caller falls back to the
+// normal login/JWT-timeout redirect. The refresh cookie is cleared only in
+// the last two cases.
+func silentlyRenewSession(w http.ResponseWriter, r *http.Request) (*Claims, bool) {
+	if config.TokenRefreshURL == "" {
+		return nil, false
+	}
+
+	refreshCookie, err := r.Cookie(oidcRefreshCookieName)
+	if err != nil || refreshCookie.Value == "" {
+		return nil, false
+	}
+
+	tokens, err := refreshOIDCTokenOnce(refreshCookie.Value)
+	if err != nil {
+		log.Printf("OIDC: silent renewal failed: %v", err)
+		recordTokenRefresh("failure")
+		clearRefreshCookie(w, r)
+		return nil, false
+	}
+
+	claims, err := jwtValidatorInstance.VerifyJWT(tokens.IDToken)
+	if err != nil {
+		log.Printf("OIDC: renewed id_token failed verification: %v", err)
+		recordTokenRefresh("failure")
+		clearRefreshCookie(w, r)
+		return nil, false
+	}
+
+	// The IdP may rotate the refresh_token or may expect the same one to
+	// be reused; when no new one came back, re-issue the current one, so
+	// the cookie is rewritten either way and its MaxAge window restarts.
+	if tokens.RefreshToken == "" {
+		tokens.RefreshToken = refreshCookie.Value
+	}
+	setOIDCSessionCookies(w, r, tokens)
+	recordTokenRefresh("success")
+
+	return claims, true
+}
+
+// oidcRedirectURI builds the absolute callback URL for the current request,
+// honoring OIDC_REDIRECT_PATH.
+func oidcRedirectURI(r *http.Request, oidc *OIDCConfig) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + oidc.RedirectPath
+}
+
+// mountOIDCRoutes registers the /oauth/login and /oauth/callback endpoints
+// on the given mux when OIDC is configured.
+func mountOIDCRoutes(mux *http.ServeMux) {
+	if config.OIDC == nil {
+		return
+	}
+	mux.HandleFunc("/oauth/login", handleOIDCLogin)
+	mux.HandleFunc(config.OIDC.RedirectPath, handleOIDCCallback)
+}
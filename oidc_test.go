@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestSignAndVerifyOIDCValue(t *testing.T) {
+	secret := []byte("test-secret")
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"simple state", "abc123"},
+		{"value with dots from a path with extension", "abc123|/billing/invoice.pdf"},
+		{"value with multiple dots", "abc123|/a.b.c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed := signOIDCValue(secret, tt.value)
+			got, ok := verifyOIDCValue(secret, signed)
+			if !ok {
+				t.Fatalf("verifyOIDCValue() failed to verify a value it just signed: %q", signed)
+			}
+			if got != tt.value {
+				t.Errorf("verifyOIDCValue() = %q, want %q", got, tt.value)
+			}
+		})
+	}
+}
+
+func TestVerifyOIDCValueRejectsTampering(t *testing.T) {
+	secret := []byte("test-secret")
+	signed := signOIDCValue(secret, "abc123|/billing/invoice.pdf")
+
+	if _, ok := verifyOIDCValue(secret, signed+"x"); ok {
+		t.Error("verifyOIDCValue() accepted a tampered signature")
+	}
+	if _, ok := verifyOIDCValue([]byte("other-secret"), signed); ok {
+		t.Error("verifyOIDCValue() accepted a value signed with a different secret")
+	}
+	if _, ok := verifyOIDCValue(secret, "no-dot-no-signature"); ok {
+		t.Error("verifyOIDCValue() accepted a value with no signature separator")
+	}
+}
+
+func TestIsLocalRedirectPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/billing", true},
+		{"/billing/invoice.pdf", true},
+		{"", false},
+		{"//evil.example.com", false},
+		{"/\\evil.example.com", false},
+		{"https://evil.example.com", false},
+		{"http://evil.example.com/path", false},
+		{"evil.example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := isLocalRedirectPath(tt.path); got != tt.want {
+				t.Errorf("isLocalRedirectPath(%q) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
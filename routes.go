@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Load balancing strategies for a Route's upstream pool.
+const (
+	StrategyRoundRobin      = "round-robin"
+	StrategyLeastConnection = "least-connections"
+)
+
+// contextKey avoids collisions with other packages' context values.
+type contextKey string
+
+const (
+	claimsContextKey      = contextKey("claims")
+	routeTargetContextKey = contextKey("routeTarget")
+)
+
+// Route describes a single host/path rule: requests matching it are load
+// balanced across Upstreams and, optionally, gated on RequiredClaims.
+type Route struct {
+	Host           string            `json:"host,omitempty"`
+	PathPrefix     string            `json:"pathPrefix"`
+	Upstreams      []string          `json:"upstreams"`
+	Strategy       string            `json:"strategy,omitempty"`
+	StripPrefix    bool              `json:"stripPrefix,omitempty"`
+	RequiredClaims map[string]string `json:"requiredClaims,omitempty"`
+	PublicPaths    []string          `json:"publicPaths,omitempty"`
+}
+
+// RouteTable is an ordered list of routes, matched first-to-last, each
+// backed by its own load-balanced upstream pool.
+type RouteTable struct {
+	routes []Route
+	pools  []*upstreamPool
+}
+
+// newRouteTable builds a RouteTable and the upstream pool for each route.
+func newRouteTable(routes []Route) *RouteTable {
+	rt := &RouteTable{
+		routes: routes,
+		pools:  make([]*upstreamPool, len(routes)),
+	}
+	for i, route := range routes {
+		rt.pools[i] = newUpstreamPool(route.Upstreams, route.Strategy)
+	}
+	return rt
+}
+
+// trivialRouteTable builds a single-route table for a single upstream,
+// used as the shim for the legacy PORT:UPSTREAM_URL configuration format.
+func trivialRouteTable(upstreamURL string) *RouteTable {
+	return newRouteTable([]Route{
+		{PathPrefix: "/", Upstreams: []string{upstreamURL}, Strategy: StrategyRoundRobin},
+	})
+}
+
+// match returns the first route whose Host (if set) and PathPrefix match
+// the request, along with its upstream pool.
+func (rt *RouteTable) match(host, path string) (*Route, *upstreamPool, bool) {
+	for i := range rt.routes {
+		route := &rt.routes[i]
+		if route.Host != "" && !hostMatches(route.Host, host) {
+			continue
+		}
+		if !strings.HasPrefix(path, route.PathPrefix) {
+			continue
+		}
+		return route, rt.pools[i], true
+	}
+	return nil, nil, false
+}
+
+// hostMatches compares a route's configured host against a request's Host
+// header, ignoring any port suffix on the request side.
+func hostMatches(routeHost, requestHost string) bool {
+	if h, _, err := net.SplitHostPort(requestHost); err == nil {
+		requestHost = h
+	}
+	return strings.EqualFold(routeHost, requestHost)
+}
+
+// isRoutePublicPath checks a route's own public path overrides, in
+// addition to the global PUBLIC_PATHS list.
+func isRoutePublicPath(route *Route, path string) bool {
+	for _, publicPath := range route.PublicPaths {
+		if strings.HasPrefix(path, publicPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeClaimsSatisfied checks a route's RequiredClaims (e.g. group/role
+// gating) against the verified JWT claims.
+func routeClaimsSatisfied(route *Route, claims *Claims) bool {
+	if len(route.RequiredClaims) == 0 {
+		return true
+	}
+
+	for key, want := range route.RequiredClaims {
+		got, ok := claims.Raw[key]
+		if !ok || !claimMatches(got, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// claimMatches reports whether want satisfies a claim value got: for a
+// scalar claim, equality; for a JSON array claim (e.g. "groups":
+// ["admin","ops"], decoded as []interface{}), membership, since group/role
+// claims are almost always arrays rather than single values.
+func claimMatches(got interface{}, want string) bool {
+	if values, ok := got.([]interface{}); ok {
+		for _, v := range values {
+			if fmt.Sprintf("%v", v) == want {
+				return true
+			}
+		}
+		return false
+	}
+	return fmt.Sprintf("%v", got) == want
+}
+
+// upstreamPool load balances across a route's upstream URLs using either
+// round-robin or least-connections.
+type upstreamPool struct {
+	upstreams []string
+	strategy  string
+
+	mu      sync.Mutex
+	rrIndex int
+	active  []int64
+}
+
+// newUpstreamPool builds a pool for the given upstreams, defaulting to
+// round-robin when strategy is unset or unrecognized.
+func newUpstreamPool(upstreams []string, strategy string) *upstreamPool {
+	if strategy != StrategyLeastConnection {
+		strategy = StrategyRoundRobin
+	}
+	return &upstreamPool{
+		upstreams: upstreams,
+		strategy:  strategy,
+		active:    make([]int64, len(upstreams)),
+	}
+}
+
+// acquire picks an upstream according to the pool's strategy and marks it
+// as having one more in-flight request. The returned index must be passed
+// to release once the request completes.
+func (p *upstreamPool) acquire() (string, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.upstreams) == 0 {
+		return "", -1
+	}
+
+	var idx int
+	if p.strategy == StrategyLeastConnection {
+		idx = 0
+		for i := 1; i < len(p.upstreams); i++ {
+			if p.active[i] < p.active[idx] {
+				idx = i
+			}
+		}
+	} else {
+		idx = p.rrIndex % len(p.upstreams)
+		p.rrIndex++
+	}
+
+	p.active[idx]++
+	return p.upstreams[idx], idx
+}
+
+// release marks an upstream's in-flight request as complete.
+func (p *upstreamPool) release(idx int) {
+	if idx < 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if idx < len(p.active) && p.active[idx] > 0 {
+		p.active[idx]--
+	}
+}
+
+// createRoutingProxy builds the single reverse proxy used for every route
+// on a server: the upstream for each request is resolved by the dispatch
+// handler and passed along via context, since it can differ per request.
+func createRoutingProxy(port int) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			target, _ := req.Context().Value(routeTargetContextKey).(*url.URL)
+			if target == nil {
+				return
+			}
+
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.Host = target.Host
+			if basePath := strings.TrimSuffix(target.Path, "/"); basePath != "" {
+				req.URL.Path = basePath + req.URL.Path
+				req.URL.RawPath = ""
+			}
+
+			if claims, ok := req.Context().Value(claimsContextKey).(*Claims); ok {
+				userID := claims.UserID
+				if userID == "" {
+					userID = claims.Sub
+				}
+				req.Header.Set("X-User-Id", userID)
+				req.Header.Set("X-User-Email", claims.Email)
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			recordProxyError(r, port, err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadGateway)
+			fmt.Fprintf(w, `{"error":"Bad Gateway","message":"Failed to connect to upstream server"}`)
+		},
+	}
+}
+
+// routeDispatchHandler matches each request against the route table, load
+// balances across the matched route's upstreams, strips the path prefix
+// when configured, and proxies the request (or hands it off to the
+// WebSocket handler for upgrade requests).
+func routeDispatchHandler(port int, routes *RouteTable, proxy *httputil.ReverseProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route, pool, ok := routes.match(r.Host, r.URL.Path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if isWebSocketUpgrade(r) {
+			handleWebSocket(route, pool, port)(w, r)
+			return
+		}
+
+		upstream, idx := pool.acquire()
+		if upstream == "" {
+			http.Error(w, "No upstream available", http.StatusBadGateway)
+			return
+		}
+		defer pool.release(idx)
+
+		target, err := url.Parse(upstream)
+		if err != nil {
+			http.Error(w, "Invalid upstream URL", http.StatusBadGateway)
+			return
+		}
+
+		if route.StripPrefix {
+			r.URL.Path = strings.TrimPrefix(r.URL.Path, route.PathPrefix)
+			if !strings.HasPrefix(r.URL.Path, "/") {
+				r.URL.Path = "/" + r.URL.Path
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), routeTargetContextKey, target)
+
+		start := time.Now()
+		rec := &statusRecordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		proxy.ServeHTTP(rec, r.WithContext(ctx))
+		recordUpstreamStatus(r, port, upstream, rec.status, start)
+	}
+}
+
+// statusRecordingResponseWriter captures the status code written by the
+// reverse proxy (or its ErrorHandler), which httputil.ReverseProxy doesn't
+// otherwise expose to the caller.
+type statusRecordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestRouteClaimsSatisfied(t *testing.T) {
+	tests := []struct {
+		name   string
+		route  *Route
+		claims *Claims
+		want   bool
+	}{
+		{
+			name:   "no required claims always satisfied",
+			route:  &Route{},
+			claims: &Claims{},
+			want:   true,
+		},
+		{
+			name:  "scalar claim matches",
+			route: &Route{RequiredClaims: map[string]string{"role": "admin"}},
+			claims: &Claims{Raw: map[string]interface{}{
+				"role": "admin",
+			}},
+			want: true,
+		},
+		{
+			name:  "scalar claim mismatch",
+			route: &Route{RequiredClaims: map[string]string{"role": "admin"}},
+			claims: &Claims{Raw: map[string]interface{}{
+				"role": "viewer",
+			}},
+			want: false,
+		},
+		{
+			name:  "array claim contains required value",
+			route: &Route{RequiredClaims: map[string]string{"groups": "admin"}},
+			claims: &Claims{Raw: map[string]interface{}{
+				"groups": []interface{}{"admin", "ops"},
+			}},
+			want: true,
+		},
+		{
+			name:  "array claim missing required value",
+			route: &Route{RequiredClaims: map[string]string{"groups": "admin"}},
+			claims: &Claims{Raw: map[string]interface{}{
+				"groups": []interface{}{"ops", "dev"},
+			}},
+			want: false,
+		},
+		{
+			name:   "missing claim fails",
+			route:  &Route{RequiredClaims: map[string]string{"role": "admin"}},
+			claims: &Claims{Raw: map[string]interface{}{}},
+			want:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := routeClaimsSatisfied(tt.route, tt.claims); got != tt.want {
+				t.Errorf("routeClaimsSatisfied() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
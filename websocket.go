@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultWSBufferSize is the chunk size used to pump a WebSocket connection.
+const defaultWSBufferSize = 32 * 1024
+
+// wsDialTimeout bounds how long dialing a WebSocket upstream may take.
+const wsDialTimeout = 10 * time.Second
+
+// wsIdleTimeout bounds how long either leg of a proxied WebSocket connection
+// may go without a successful read or write before the pump gives up on it.
+// It's reset on every read/write. Being a raw byte pump rather than
+// frame-aware, this proxy can't tell a stuck peer (dead link, black-holing
+// firewall) from one that's merely idle between messages: a leg that carries
+// no bytes, keepalive pings included, for this long is ended either way.
+const wsIdleTimeout = 60 * time.Second
+
+// handleWebSocket handles WebSocket upgrade requests with JWT verification,
+// proxying to an upstream chosen from the matched route's pool over a
+// hijacked, bidirectionally-pumped connection.
+func handleWebSocket(route *Route, pool *upstreamPool, port int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		if !isPublicPath(r.URL.Path) && !isRoutePublicPath(route, r.URL.Path) {
+			cookieHeader := r.Header.Get("Cookie")
+			cookies := parseCookies(cookieHeader)
+			token, ok := cookies[config.JWTCookieName]
+
+			if !ok {
+				recordAuthDecision(r, start, "ws-unauthorized", nil)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			claims, err := jwtValidatorInstance.VerifyJWT(token)
+			if err != nil {
+				recordAuthDecision(r, start, "ws-unauthorized", nil)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+			r = r.WithContext(ctx)
+		}
+
+		upstream, idx := pool.acquire()
+		if upstream == "" {
+			http.Error(w, "No upstream available", http.StatusBadGateway)
+			return
+		}
+		defer pool.release(idx)
+
+		target, err := url.Parse(upstream)
+		if err != nil {
+			http.Error(w, "Invalid upstream URL", http.StatusInternalServerError)
+			return
+		}
+
+		rewriteWSRequestPath(r, route, target)
+
+		targetConn, err := dialWSUpstream(target)
+		if err != nil {
+			log.Printf("[Port %d] Failed to connect to WebSocket upstream %s: %v", port, upstream, err)
+			http.Error(w, "Failed to connect to upstream", http.StatusBadGateway)
+			return
+		}
+		defer targetConn.Close()
+
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+			return
+		}
+
+		clientConn, clientBuf, err := hijacker.Hijack()
+		if err != nil {
+			http.Error(w, "Failed to hijack connection", http.StatusInternalServerError)
+			return
+		}
+		defer clientConn.Close()
+
+		if claims, ok := r.Context().Value(claimsContextKey).(*Claims); ok {
+			userID := claims.UserID
+			if userID == "" {
+				userID = claims.Sub
+			}
+			r.Header.Set("X-User-Id", userID)
+			r.Header.Set("X-User-Email", claims.Email)
+		}
+
+		if err := r.Write(targetConn); err != nil {
+			log.Printf("[Port %d] Failed to write WebSocket upgrade request: %v", port, err)
+			return
+		}
+
+		log.Printf("[Port %d] Proxying WebSocket upgrade for %s to %s", port, r.URL.Path, upstream)
+
+		// clientBuf.Reader may already hold bytes the server read past the
+		// request line and headers while buffering the hijacked connection;
+		// read through it rather than clientConn directly so none of that
+		// is silently dropped.
+		pumpWebSocket(r.Context(), clientConn, clientBuf.Reader, targetConn)
+	}
+}
+
+// rewriteWSRequestPath mirrors the HTTP proxying path's prefix stripping
+// and applies the upstream URL's own base path (if any), so a route's
+// StripPrefix and an upstream like "http://backend:8080/api" are honored
+// for WebSocket upgrades the same way they are for ordinary requests.
+func rewriteWSRequestPath(r *http.Request, route *Route, target *url.URL) {
+	if route.StripPrefix {
+		r.URL.Path = strings.TrimPrefix(r.URL.Path, route.PathPrefix)
+		if !strings.HasPrefix(r.URL.Path, "/") {
+			r.URL.Path = "/" + r.URL.Path
+		}
+	}
+
+	if basePath := strings.TrimSuffix(target.Path, "/"); basePath != "" {
+		r.URL.Path = basePath + r.URL.Path
+	}
+}
+
+// dialWSUpstream opens a TCP (or, for https/wss upstreams, TLS) connection
+// to target's host, so WebSocket upgrades proxy correctly to TLS-terminating
+// upstreams instead of always speaking plaintext to them.
+func dialWSUpstream(target *url.URL) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: wsDialTimeout}
+	if target.Scheme == "https" || target.Scheme == "wss" {
+		return tls.DialWithDialer(dialer, "tcp", target.Host, &tls.Config{})
+	}
+	return dialer.Dial("tcp", target.Host)
+}
+
+// connCloseWriter is implemented by net.Conn types (TCP, TLS) that support
+// half-closing their write side without tearing down the read side.
+type connCloseWriter interface {
+	CloseWrite() error
+}
+
+// pumpWebSocket copies data bidirectionally between the client and the
+// upstream connection. Each leg closes only its own write side once its
+// source is exhausted (a half-close), so a peer that's still sending data
+// after the other side finishes isn't cut off; once both legs have
+// finished, or ctx is canceled (e.g. on server shutdown), both connections
+// are closed outright to unblock anything still waiting on them.
+func pumpWebSocket(ctx context.Context, clientConn net.Conn, clientReader io.Reader, targetConn net.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			clientConn.Close()
+			targetConn.Close()
+		case <-done:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		if err := copyWSFrames(targetConn, clientConn, clientReader); err != nil {
+			log.Printf("WebSocket client->upstream copy ended: %v", err)
+		}
+		halfCloseWrite(targetConn)
+	}()
+
+	go func() {
+		defer wg.Done()
+		if err := copyWSFrames(clientConn, targetConn, targetConn); err != nil {
+			log.Printf("WebSocket upstream->client copy ended: %v", err)
+		}
+		halfCloseWrite(clientConn)
+	}()
+
+	wg.Wait()
+	targetConn.Close()
+	clientConn.Close()
+}
+
+// halfCloseWrite closes conn's write half so the peer sees a clean EOF,
+// without discarding any data still in flight on the read half. Connection
+// types that don't support a half-close just get a full close.
+func halfCloseWrite(conn net.Conn) {
+	if cw, ok := conn.(connCloseWriter); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// copyWSFrames copies from src to dst, resetting srcConn's read deadline
+// (and dst's write deadline) on every chunk so a peer that goes silent
+// without closing the connection trips wsIdleTimeout instead of blocking
+// forever, and capping the total bytes read over the connection's lifetime
+// at config.WSMaxConnBytes (when set) via a limited-reader wrapper. This
+// pump copies raw bytes with no notion of WebSocket frame boundaries, so
+// the cap is a connection-lifetime total, not a per-message limit - a
+// long-lived, low-traffic connection can still trip it even though no
+// single message was ever large.
+func copyWSFrames(dst net.Conn, srcConn net.Conn, src io.Reader) error {
+	limited := limitWSReader(src, config.WSMaxConnBytes)
+	buf := make([]byte, defaultWSBufferSize)
+
+	for {
+		srcConn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		n, rerr := limited.Read(buf)
+		if n > 0 {
+			dst.SetWriteDeadline(time.Now().Add(wsIdleTimeout))
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				return nil
+			}
+			return rerr
+		}
+	}
+}
+
+// wsLimitedReader wraps an io.Reader and errors once more than max bytes
+// have been read from it in total over the connection's lifetime, rather
+// than silently truncating like io.LimitReader does - truncation would
+// look just like the peer cleanly closing the connection and mask the
+// fact that the connection was rejected for exceeding the cap.
+type wsLimitedReader struct {
+	io.Reader
+	max       int64
+	remaining int64
+}
+
+// limitWSReader returns r unmodified when max is 0 (unlimited), per
+// config.WSMaxConnBytes's "0 means unlimited" contract.
+func limitWSReader(r io.Reader, max int64) io.Reader {
+	if max <= 0 {
+		return r
+	}
+	return &wsLimitedReader{Reader: r, max: max, remaining: max}
+}
+
+func (l *wsLimitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		return 0, fmt.Errorf("websocket connection exceeds %d byte lifetime limit", l.max)
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.Reader.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// isWebSocketUpgrade checks if the request is a WebSocket upgrade request
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.ToLower(r.Header.Get("Connection")) == "upgrade" &&
+		strings.ToLower(r.Header.Get("Upgrade")) == "websocket"
+}